@@ -1,11 +1,11 @@
 package signalr
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,47 +31,108 @@ type receiveResult struct {
 	err     error
 }
 
-func newHubConnection(connection Connection, protocol hubProtocol, maximumReceiveMessageSize uint, info StructuredLogger) hubConnection {
+// MessageStream reads and writes whole hub messages; it owns framing and
+// partial-frame buffering so callers always deal in complete messages.
+type MessageStream interface {
+	ReadMessage(ctx context.Context) (hubMessage, error)
+	WriteMessage(ctx context.Context, message interface{}) error
+}
+
+// ErrMessageTooLarge is returned by a MessageStream's ReadMessage when a single
+// message exceeds the maximumReceiveMessageSize it was created with, so callers
+// can tell a framing limit apart from an ordinary transport error.
+var ErrMessageTooLarge = errors.New("signalr: message exceeds maximum receive message size")
+
+// Default timeouts from the SignalR protocol spec, used when a HubConnectionOption
+// does not override them.
+const (
+	defaultKeepAliveInterval = 15 * time.Second
+	defaultServerTimeout     = 30 * time.Second
+)
+
+// HubConnectionOption configures optional timeouts of a defaultHubConnection.
+// It is applied by newHubConnection before the connection is handed to the caller.
+type HubConnectionOption func(*defaultHubConnection)
+
+// WithKeepAliveInterval overrides the interval after which a Ping is sent when
+// no other message has been written (KeepAliveInterval in the SignalR spec).
+func WithKeepAliveInterval(d time.Duration) HubConnectionOption {
+	return func(c *defaultHubConnection) { c.keepAliveInterval = d }
+}
+
+// WithServerTimeout overrides the duration after which the connection is aborted
+// when no message, including pings, has been received (ServerTimeout in the SignalR spec).
+func WithServerTimeout(d time.Duration) HubConnectionOption {
+	return func(c *defaultHubConnection) { c.serverTimeout = d }
+}
+
+func newHubConnection(connection Connection, protocol hubProtocol, maximumReceiveMessageSize uint, info StructuredLogger, options ...HubConnectionOption) hubConnection {
 	ctx, cancelFunc := context.WithCancel(connection.Context())
+	now := time.Now()
 	c := &defaultHubConnection{
-		ctx:                       ctx,
-		cancelFunc:                cancelFunc,
-		protocol:                  protocol,
-		mx:                        sync.Mutex{},
-		connection:                connection,
-		maximumReceiveMessageSize: maximumReceiveMessageSize,
-		items:                     &sync.Map{},
-		info:                      info,
+		ctx:               ctx,
+		cancelFunc:        cancelFunc,
+		protocol:          protocol,
+		stream:            protocol.NewStream(connection, maximumReceiveMessageSize),
+		mx:                sync.Mutex{},
+		connection:        connection,
+		items:             &sync.Map{},
+		info:              info,
+		lastWriteStamp:    now,
+		lastReadStamp:     now,
+		keepAliveInterval: defaultKeepAliveInterval,
+		serverTimeout:     defaultServerTimeout,
+	}
+	for _, option := range options {
+		option(c)
 	}
 	if connectionWithTransferMode, ok := connection.(ConnectionWithTransferMode); ok {
 		connectionWithTransferMode.SetTransferMode(protocol.transferMode())
 	}
+	go c.watchKeepAlive()
 	return c
 }
 
 type defaultHubConnection struct {
-	ctx                       context.Context
-	cancelFunc                context.CancelFunc
-	protocol                  hubProtocol
-	mx                        sync.Mutex
-	connection                Connection
-	maximumReceiveMessageSize uint
-	items                     *sync.Map
-	lastWriteStamp            time.Time
-	info                      StructuredLogger
+	ctx               context.Context
+	cancelFunc        context.CancelFunc
+	protocol          hubProtocol
+	stream            MessageStream
+	mx                sync.Mutex
+	connection        Connection
+	items             *sync.Map
+	stampMx           sync.Mutex
+	lastWriteStamp    time.Time
+	lastReadStamp     time.Time
+	keepAliveInterval time.Duration
+	serverTimeout     time.Duration
+	pingInFlight      int32
+	info              StructuredLogger
 }
 
 func (c *defaultHubConnection) Items() *sync.Map {
 	return c.items
 }
 
+// Close writes the close frame even if the connection was already aborted, so
+// a caller that aborts on a fatal error and then calls Close to tell the peer
+// why still gets the frame on the wire.
 func (c *defaultHubConnection) Close(errorText string, allowReconnect bool) error {
 	var closeMessage = closeMessage{
 		Type:           7,
 		Error:          errorText,
 		AllowReconnect: allowReconnect,
 	}
-	return c.protocol.WriteMessage(closeMessage, c.connection)
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.stampMx.Lock()
+	c.lastWriteStamp = time.Now()
+	c.stampMx.Unlock()
+	err := c.stream.WriteMessage(context.Background(), closeMessage)
+	if err != nil {
+		_ = c.info.Log(evt, msgSend, "message", fmtMsg(closeMessage), "error", err)
+	}
+	return err
 }
 
 func (c *defaultHubConnection) ConnectionID() string {
@@ -86,62 +147,31 @@ func (c *defaultHubConnection) Abort() {
 	c.cancelFunc()
 }
 
+// Receive loops MessageStream.ReadMessage and emits each message, or the
+// terminal error, on recvChan.
 func (c *defaultHubConnection) Receive() <-chan receiveResult {
 	recvChan := make(chan receiveResult, 20)
-	// Prepare cleanup
-	done := make(chan struct{}, 2)
-	go func(recvChan chan receiveResult, done chan struct{}) {
-		<-done
-		<-done
-		close(done)
-		close(recvChan)
-	}(recvChan, done)
-	// the pipe connects the goroutine which reads from the connection and the goroutine which parses the read data
-	reader, writer := io.Pipe()
-	p := make([]byte, c.maximumReceiveMessageSize)
-	go func(ctx context.Context, connection io.Reader, writer io.Writer, recvChan chan<- receiveResult, done chan<- struct{}) {
+	go func() {
+		defer close(recvChan)
 		for {
-			if ctx.Err() != nil {
-				break
+			if c.ctx.Err() != nil {
+				return
 			}
-			n, err := connection.Read(p)
+			message, err := c.stream.ReadMessage(c.ctx)
 			if err != nil {
-				recvChan <- receiveResult{err: err}
-			}
-			if ctx.Err() != nil {
-				break
-			}
-			if n > 0 {
-				_, err = writer.Write(p[:n])
-				if err != nil {
+				if c.ctx.Err() == nil {
 					recvChan <- receiveResult{err: err}
 				}
+				return
 			}
-		}
-		// The pipe reader is done
-		done <- struct{}{}
-	}(c.ctx, c.connection, writer, recvChan, done)
-	// parse
-	go func(ctx context.Context, reader io.Reader, recvChan chan<- receiveResult, done chan<- struct{}) {
-		remainBuf := bytes.Buffer{}
-		for {
-			if ctx.Err() != nil {
-				break
-			}
-			messages, err := c.protocol.ParseMessages(reader, &remainBuf)
-			if err != nil {
-				recvChan <- receiveResult{err: err}
-			} else {
-				for _, message := range messages {
-					if ctx.Err() == nil {
-						recvChan <- receiveResult{message: message}
-					}
-				}
+			c.stampMx.Lock()
+			c.lastReadStamp = time.Now()
+			c.stampMx.Unlock()
+			if c.ctx.Err() == nil {
+				recvChan <- receiveResult{message: message}
 			}
 		}
-		// The parser is done
-		done <- struct{}{}
-	}(c.ctx, reader, recvChan, done)
+	}()
 	return recvChan
 }
 
@@ -195,34 +225,72 @@ func (c *defaultHubConnection) Ping() error {
 	return c.writeMessage(pingMessage)
 }
 
+// LastWriteStamp and lastReadStamp use stampMx rather than mx, which a blocked
+// write can hold for as long as the peer stalls.
 func (c *defaultHubConnection) LastWriteStamp() time.Time {
-	defer c.mx.Unlock()
-	c.mx.Lock()
+	defer c.stampMx.Unlock()
+	c.stampMx.Lock()
 	return c.lastWriteStamp
 }
 
-func (c *defaultHubConnection) writeMessage(message interface{}) error {
-	c.mx.Lock()
-	c.lastWriteStamp = time.Now()
-	c.mx.Unlock()
-	err := func() error {
-		if c.ctx.Err() != nil {
-			return fmt.Errorf("hubConnection canceled: %w", c.ctx.Err())
-		}
-		e := make(chan error, 1)
-		go func() { e <- c.protocol.WriteMessage(message, c.connection) }()
+func (c *defaultHubConnection) lastReadStampValue() time.Time {
+	defer c.stampMx.Unlock()
+	c.stampMx.Lock()
+	return c.lastReadStamp
+}
+
+// watchKeepAlive pings when nothing has been written for KeepAliveInterval,
+// and aborts when nothing has been read within ServerTimeout.
+func (c *defaultHubConnection) watchKeepAlive() {
+	interval := c.keepAliveInterval / 4
+	if c.serverTimeout/4 < interval {
+		interval = c.serverTimeout / 4
+	}
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
 		select {
 		case <-c.ctx.Done():
-			return fmt.Errorf("hubConnection canceled: %w", c.ctx.Err())
-		case err := <-e:
-			if err != nil {
+			return
+		case <-ticker.C:
+			if time.Since(c.lastReadStampValue()) > c.serverTimeout {
 				c.Abort()
+				return
+			}
+			// At most one Ping in flight: if stream.WriteMessage is stuck on a
+			// stalled peer, further ticks must not pile up goroutines queuing
+			// on mx behind it.
+			if time.Since(c.LastWriteStamp()) > c.keepAliveInterval &&
+				atomic.CompareAndSwapInt32(&c.pingInFlight, 0, 1) {
+				go func() {
+					defer atomic.StoreInt32(&c.pingInFlight, 0)
+					_ = c.Ping()
+				}()
 			}
-			return err
 		}
-	}()
+	}
+}
+
+// writeMessage writes message through the MessageStream under mx, so a ping
+// and an application write can never interleave on the wire.
+func (c *defaultHubConnection) writeMessage(message interface{}) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.ctx.Err() != nil {
+		err := fmt.Errorf("hubConnection canceled: %w", c.ctx.Err())
+		_ = c.info.Log(evt, msgSend, "message", fmtMsg(message), "error", err)
+		return err
+	}
+	c.stampMx.Lock()
+	c.lastWriteStamp = time.Now()
+	c.stampMx.Unlock()
+	err := c.stream.WriteMessage(c.ctx, message)
 	if err != nil {
 		_ = c.info.Log(evt, msgSend, "message", fmtMsg(message), "error", err)
+		c.Abort()
 	}
 	return err
 }
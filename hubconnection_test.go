@@ -0,0 +1,124 @@
+package signalr
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// blockingMessageStream never returns from ReadMessage until its context is
+// done, simulating a peer that has stopped sending anything, including pings.
+type blockingMessageStream struct {
+	writeMx sync.Mutex
+	writes  int
+}
+
+func (s *blockingMessageStream) ReadMessage(ctx context.Context) (hubMessage, error) {
+	<-ctx.Done()
+	return hubMessage{}, ctx.Err()
+}
+
+func (s *blockingMessageStream) WriteMessage(ctx context.Context, message interface{}) error {
+	s.writeMx.Lock()
+	defer s.writeMx.Unlock()
+	s.writes++
+	return nil
+}
+
+// blockingWriteMessageStream never returns from WriteMessage until its context
+// is done, simulating a peer whose socket buffer never drains: a ping sent
+// into it hangs forever. writes counts how many WriteMessage calls were ever
+// started, to catch a watchdog that piles up one goroutine per tick instead of
+// keeping a single Ping in flight.
+type blockingWriteMessageStream struct {
+	readCtx context.Context
+	writes  int32
+}
+
+func (s *blockingWriteMessageStream) ReadMessage(ctx context.Context) (hubMessage, error) {
+	<-s.readCtx.Done()
+	return hubMessage{}, s.readCtx.Err()
+}
+
+func (s *blockingWriteMessageStream) WriteMessage(ctx context.Context, message interface{}) error {
+	atomic.AddInt32(&s.writes, 1)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+type fakeKeepAliveProtocol struct {
+	stream MessageStream
+}
+
+func (p *fakeKeepAliveProtocol) NewStream(io.ReadWriter, uint) MessageStream {
+	return p.stream
+}
+
+func (p *fakeKeepAliveProtocol) transferMode() TransferMode {
+	return TextTransferMode
+}
+
+// fakeConnection is a Connection whose Read blocks until its context is done,
+// standing in for a peer that never sends anything on the wire.
+type fakeConnection struct {
+	ctx context.Context
+}
+
+func (f *fakeConnection) ConnectionID() string { return "fakeConnection" }
+
+func (f *fakeConnection) Write(p []byte) (int, error) { return len(p), nil }
+
+func (f *fakeConnection) Read(p []byte) (int, error) {
+	<-f.ctx.Done()
+	return 0, f.ctx.Err()
+}
+
+func (f *fakeConnection) Context() context.Context { return f.ctx }
+
+type fakeLogger struct{}
+
+func (f *fakeLogger) Log(keyvals ...interface{}) error { return nil }
+
+var _ = Describe("hubConnection keepalive", func() {
+	It("aborts the connection when nothing is read within ServerTimeout", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		conn := &fakeConnection{ctx: ctx}
+		protocol := &fakeKeepAliveProtocol{stream: &blockingMessageStream{}}
+		hubConn := newHubConnection(conn, protocol, 1<<16, &fakeLogger{},
+			WithKeepAliveInterval(20*time.Millisecond),
+			WithServerTimeout(60*time.Millisecond),
+		)
+
+		Eventually(func() error {
+			return hubConn.Context().Err()
+		}, 500*time.Millisecond, 5*time.Millisecond).Should(HaveOccurred())
+	})
+
+	It("still aborts on ServerTimeout when a keepalive Ping's write blocks forever", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		conn := &fakeConnection{ctx: ctx}
+		stream := &blockingWriteMessageStream{readCtx: ctx}
+		protocol := &fakeKeepAliveProtocol{stream: stream}
+		hubConn := newHubConnection(conn, protocol, 1<<16, &fakeLogger{},
+			WithKeepAliveInterval(10*time.Millisecond),
+			WithServerTimeout(60*time.Millisecond),
+		)
+
+		// A blocked Ping write must not be able to wedge the watchdog's own
+		// ServerTimeout check (see writeMessage/stampMx).
+		Eventually(func() error {
+			return hubConn.Context().Err()
+		}, 500*time.Millisecond, 5*time.Millisecond).Should(HaveOccurred())
+
+		// Dozens of ticks fire while that single Ping write is stuck; only one
+		// of them may ever have started a write.
+		Expect(atomic.LoadInt32(&stream.writes)).To(BeNumerically("<=", 1))
+	})
+})
@@ -0,0 +1,80 @@
+package signalr
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+)
+
+// jsonRecordSeparator terminates every frame of the SignalR JSON hub protocol.
+const jsonRecordSeparator = byte(0x1e)
+
+// jsonHubProtocol implements hubProtocol using record-separator-delimited JSON.
+type jsonHubProtocol struct{}
+
+func (j *jsonHubProtocol) transferMode() TransferMode {
+	return TextTransferMode
+}
+
+func (j *jsonHubProtocol) NewStream(rw io.ReadWriter, maximumReceiveMessageSize uint) MessageStream {
+	return NewJSONStream(rw, maximumReceiveMessageSize)
+}
+
+// NewJSONStream wraps rw in a MessageStream that reads and writes whole
+// SignalR JSON hub protocol frames, enforcing maximumReceiveMessageSize
+// (0 means unlimited) against each received frame as it is read.
+func NewJSONStream(rw io.ReadWriter, maximumReceiveMessageSize uint) MessageStream {
+	return &jsonMessageStream{
+		rw:      rw,
+		reader:  bufio.NewReader(rw),
+		maxSize: maximumReceiveMessageSize,
+	}
+}
+
+type jsonMessageStream struct {
+	rw      io.ReadWriter
+	reader  *bufio.Reader
+	maxSize uint
+}
+
+func (s *jsonMessageStream) ReadMessage(ctx context.Context) (hubMessage, error) {
+	frame, err := readDelimitedFrame(s.reader, jsonRecordSeparator, s.maxSize)
+	if err != nil {
+		return hubMessage{}, err
+	}
+	var message hubMessage
+	if err := json.Unmarshal(frame, &message); err != nil {
+		return hubMessage{}, err
+	}
+	return message, nil
+}
+
+func (s *jsonMessageStream) WriteMessage(ctx context.Context, message interface{}) error {
+	frame, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return writeWithContext(ctx, s.rw, append(frame, jsonRecordSeparator))
+}
+
+// readDelimitedFrame reads bytes up to and excluding delim. It stops and
+// returns ErrMessageTooLarge as soon as the frame would exceed maxSize (0
+// means unlimited), instead of buffering an unbounded amount of data while
+// waiting for a delimiter that may never come.
+func readDelimitedFrame(r *bufio.Reader, delim byte, maxSize uint) ([]byte, error) {
+	var frame []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == delim {
+			return frame, nil
+		}
+		frame = append(frame, b)
+		if maxSize > 0 && uint(len(frame)) > maxSize {
+			return nil, ErrMessageTooLarge
+		}
+	}
+}
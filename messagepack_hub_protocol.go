@@ -0,0 +1,70 @@
+package signalr
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// messagePackHubProtocol implements hubProtocol using the length-prefixed
+// MessagePack framing of the SignalR MessagePack hub protocol: each frame is
+// a base-128 varint byte count followed by that many bytes of msgpack data.
+type messagePackHubProtocol struct{}
+
+func (m *messagePackHubProtocol) transferMode() TransferMode {
+	return BinaryTransferMode
+}
+
+func (m *messagePackHubProtocol) NewStream(rw io.ReadWriter, maximumReceiveMessageSize uint) MessageStream {
+	return NewMessagePackStream(rw, maximumReceiveMessageSize)
+}
+
+// NewMessagePackStream wraps rw in a MessageStream that reads and writes whole
+// SignalR MessagePack hub protocol frames, enforcing maximumReceiveMessageSize
+// (0 means unlimited) against each received frame's declared length before
+// that many bytes are ever read off the wire.
+func NewMessagePackStream(rw io.ReadWriter, maximumReceiveMessageSize uint) MessageStream {
+	return &messagePackMessageStream{
+		rw:      rw,
+		reader:  bufio.NewReader(rw),
+		maxSize: maximumReceiveMessageSize,
+	}
+}
+
+type messagePackMessageStream struct {
+	rw      io.ReadWriter
+	reader  *bufio.Reader
+	maxSize uint
+}
+
+func (s *messagePackMessageStream) ReadMessage(ctx context.Context) (hubMessage, error) {
+	size, err := binary.ReadUvarint(s.reader)
+	if err != nil {
+		return hubMessage{}, err
+	}
+	if s.maxSize > 0 && size > uint64(s.maxSize) {
+		return hubMessage{}, ErrMessageTooLarge
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(s.reader, frame); err != nil {
+		return hubMessage{}, err
+	}
+	var message hubMessage
+	if err := msgpack.Unmarshal(frame, &message); err != nil {
+		return hubMessage{}, err
+	}
+	return message, nil
+}
+
+func (s *messagePackMessageStream) WriteMessage(ctx context.Context, message interface{}) error {
+	payload, err := msgpack.Marshal(message)
+	if err != nil {
+		return err
+	}
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lenBuf, uint64(len(payload)))
+	return writeWithContext(ctx, s.rw, append(lenBuf[:n], payload...))
+}
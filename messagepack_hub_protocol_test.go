@@ -0,0 +1,32 @@
+package signalr
+
+import (
+	"bytes"
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("messagePackMessageStream", func() {
+	It("round-trips a message written and read through the same stream", func() {
+		buf := &bytes.Buffer{}
+		stream := NewMessagePackStream(buf, 0)
+
+		Expect(stream.WriteMessage(context.Background(), hubMessage{Type: 6})).To(Succeed())
+
+		message, err := stream.ReadMessage(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(message.Type).To(Equal(6))
+	})
+
+	It("returns ErrMessageTooLarge instead of reading an oversized frame's payload", func() {
+		buf := &bytes.Buffer{}
+		stream := NewMessagePackStream(buf, 1)
+
+		Expect(stream.WriteMessage(context.Background(), hubMessage{Type: 6})).To(Succeed())
+
+		_, err := stream.ReadMessage(context.Background())
+		Expect(err).To(MatchError(ErrMessageTooLarge))
+	})
+})
@@ -0,0 +1,43 @@
+package signalr
+
+import (
+	"context"
+	"io"
+)
+
+// TransferMode describes whether a hubProtocol's wire format is text or binary,
+// so a Connection that cares (see ConnectionWithTransferMode) can configure itself.
+type TransferMode int
+
+const (
+	TextTransferMode   TransferMode = 1
+	BinaryTransferMode TransferMode = 2
+)
+
+// hubProtocol parses and writes the SignalR hub protocol messages exchanged
+// over a Connection. Framing and partial-frame buffering are not its concern:
+// NewStream hands back a MessageStream that owns those for the lifetime of
+// one connection, so hubConnection only ever deals in whole messages.
+type hubProtocol interface {
+	transferMode() TransferMode
+	NewStream(rw io.ReadWriter, maximumReceiveMessageSize uint) MessageStream
+}
+
+// writeWithContext writes p to w, returning ctx.Err() as soon as ctx is done
+// instead of waiting out a write that blocks on a stalled peer. The write
+// itself keeps running on the spawned goroutine until w unblocks it (e.g. by
+// closing the underlying connection), since there is no way to interrupt a
+// blocked io.Writer.Write from the outside.
+func writeWithContext(ctx context.Context, w io.Writer, p []byte) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write(p)
+		done <- err
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
@@ -0,0 +1,13 @@
+package signalr
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestSignalR(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "signalr Suite")
+}